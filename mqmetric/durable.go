@@ -0,0 +1,366 @@
+package mqmetric
+
+/*
+  Copyright (c) IBM Corporation 2018,2020
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+   Contributors:
+     Mark Taylor - Initial Contribution
+*/
+
+/*
+Functions in this file manage durable subscriptions to the resource-topic
+statistics ($SYS/MQ/INFO/QMGR/.../STATISTICS/...) published by the queue
+manager.
+
+Normally a collection interval subscribes to each resource topic, reads the
+published statistics and then closes the subscription again. That pattern
+is simple but, when a process is monitoring a large number of queues, the
+churn of MQOPEN/MQCLOSE against MQSUB can be significant and contributes to
+MAXHANDS exhaustion. Calling SetDurableSubscriptions causes
+the subscriptions to be created once, as durable subscriptions, and then
+reconnected to on every subsequent poll instead of being recreated.
+
+Durable subscriptions are named "<SubName>/<topic>" where SubName defaults
+to "mqmetric" if not configured. Operators can find and remove orphaned
+subscriptions - for example after a monitoring process has been redeployed
+with a different prefix - by running
+
+    DISPLAY SUB(<prefix>/*) SUBNAME
+
+from runmqsc, or by calling CleanupSubscriptionsByPrefix from a standalone
+tool.
+*/
+
+import (
+	"strings"
+
+	"github.com/ibm-messaging/mq-golang/v5/ibmmq"
+)
+
+const (
+	defaultDurableSubNamePrefix = "mqmetric"
+)
+
+// useDurableSubscriptions and durableSubNamePrefix are set once via
+// SetDurableSubscriptions during initial configuration, before discovery
+// or collection starts.
+var (
+	useDurableSubscriptions = false
+	durableSubNamePrefix    = defaultDurableSubNamePrefix
+	durableSubs             = make(map[string]*resourceSub)
+)
+
+// resourceSub bundles the two object handles a managed MQSUB produces: the
+// subscription itself, which must be closed (and, for durable subscriptions,
+// can be resumed by name), and the managed destination queue that MQSUB
+// creates on our behalf, which is where publications actually arrive and
+// must be GET from.
+type resourceSub struct {
+	subObj ibmmq.MQObject
+	qObj   ibmmq.MQObject
+}
+
+// SetDurableSubscriptions turns on durable, reconnectable subscriptions for
+// resource-topic statistics. The prefix is used to build the SubName of
+// each subscription as "<prefix>/<topic>" so that orphaned subscriptions
+// can be identified later, eg via DISPLAY SUB(<prefix>/*) in runmqsc. If
+// prefix is empty, the default "mqmetric" is used.
+func SetDurableSubscriptions(prefix string) {
+	traceEntry("SetDurableSubscriptions")
+	useDurableSubscriptions = true
+	if prefix == "" {
+		prefix = defaultDurableSubNamePrefix
+	}
+	durableSubNamePrefix = prefix
+	traceExit("SetDurableSubscriptions", 0)
+}
+
+// durableSubName builds the SubName used for a given resource topic,
+// following the "<prefix>/<topic>" naming convention documented above.
+func durableSubName(topic string) string {
+	return durableSubNamePrefix + "/" + topic
+}
+
+// subscribeResourceTopic opens (or, if it already exists, reconnects to) a
+// durable subscription for the given topic string and returns the
+// subscriber object that publications can be read from. When durable
+// subscriptions are not enabled, this is equivalent to a normal,
+// non-durable MQSUB.
+func subscribeResourceTopic(qMgr *ibmmq.MQQueueManager, topic string) (*resourceSub, error) {
+	traceEntryF("subscribeResourceTopic", "Topic: %s", topic)
+
+	if !useDurableSubscriptions {
+		sub, err := mqSubscribe(qMgr, topic, "", false)
+		traceExitErr("subscribeResourceTopic", 0, err)
+		return sub, err
+	}
+
+	subName := durableSubName(topic)
+	if sub, ok := durableSubs[subName]; ok {
+		traceExit("subscribeResourceTopic", 1)
+		return sub, nil
+	}
+
+	sub, err := mqSubscribe(qMgr, topic, subName, true)
+	if err == nil {
+		durableSubs[subName] = sub
+	}
+	traceExitErr("subscribeResourceTopic", 2, err)
+	return sub, err
+}
+
+// CollectResourceStatistics is the entry point a poll cycle calls to read
+// the resource-topic statistics. It routes every topic through
+// subscribeResourceTopic, so that when durable subscriptions are enabled
+// the same durable subscription object is reused on every call rather than
+// recreated, and drains whatever statistics publications are currently
+// waiting on each one. Non-durable subscriptions are closed again once
+// drained.
+func CollectResourceStatistics(qMgr *ibmmq.MQQueueManager, topics []string) error {
+	traceEntry("CollectResourceStatistics")
+
+	var firstErr error
+	for _, topic := range topics {
+		sub, err := subscribeResourceTopic(qMgr, topic)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err := drainResourceTopic(&sub.qObj); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if !useDurableSubscriptions {
+			_ = sub.subObj.Close(ibmmq.MQCO_NONE)
+			_ = sub.qObj.Close(ibmmq.MQCO_NONE)
+		}
+	}
+
+	traceExitErr("CollectResourceStatistics", 0, firstErr)
+	return firstErr
+}
+
+// drainResourceTopic reads every publication currently available on a
+// resource-topic subscription without waiting for more to arrive, so that
+// a poll cycle terminates promptly once it has caught up. Turning the raw
+// PCF group structure of a resource-statistics message into StatusSet
+// attributes is the job of the statistics collector this feeds, so it is
+// left untouched here beyond draining the message off the subscription.
+func drainResourceTopic(obj *ibmmq.MQObject) error {
+	gmo := ibmmq.NewMQGMO()
+	gmo.Options = ibmmq.MQGMO_NO_WAIT | ibmmq.MQGMO_CONVERT | ibmmq.MQGMO_ACCEPT_TRUNCATED_MSG
+
+	buf := make([]byte, 32*1024)
+	for {
+		getmqmd := ibmmq.NewMQMD()
+		_, err := obj.Get(getmqmd, gmo, buf)
+		if err != nil {
+			if mqret, ok := err.(*ibmmq.MQReturn); ok && mqret.MQRC == ibmmq.MQRC_NO_MSG_AVAILABLE {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// CleanupDurableSubscriptions closes and deletes every durable
+// subscription that this process opened during the current run. It
+// should be called once, during an orderly shutdown, by any caller that
+// called SetDurableSubscriptions.
+func CleanupDurableSubscriptions() error {
+	traceEntry("CleanupDurableSubscriptions")
+	var firstErr error
+	for subName, sub := range durableSubs {
+		if err := sub.subObj.Close(ibmmq.MQCO_REMOVE_SUB); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := sub.qObj.Close(ibmmq.MQCO_NONE); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(durableSubs, subName)
+	}
+	traceExitErr("CleanupDurableSubscriptions", 0, firstErr)
+	return firstErr
+}
+
+// mqSubscribe issues the MQSUB call for a single topic string, either as a
+// plain (non-durable) subscription or, when subName is non-empty, as a
+// durable one that can be resumed on a later call with the same name.
+func mqSubscribe(qMgr *ibmmq.MQQueueManager, topic string, subName string, durable bool) (*resourceSub, error) {
+	traceEntryF("mqSubscribe", "Topic: %s SubName: %s", topic, subName)
+
+	mqsd := ibmmq.NewMQSD()
+	mqsd.Options = ibmmq.MQSO_CREATE | ibmmq.MQSO_FAIL_IF_QUIESCING
+	if durable {
+		mqsd.Options |= ibmmq.MQSO_RESUME | ibmmq.MQSO_DURABLE | ibmmq.MQSO_MANAGED
+		mqsd.SubName = subName
+	} else {
+		mqsd.Options |= ibmmq.MQSO_NON_DURABLE | ibmmq.MQSO_MANAGED
+	}
+	mqsd.ObjectString = topic
+
+	// MQSO_MANAGED asks the queue manager to create the destination queue
+	// for us; it is returned through qObj, which publications must be read
+	// from, while subObj is only the subscription handle.
+	var qObj ibmmq.MQObject
+	subObj, err := qMgr.Sub(mqsd, &qObj)
+	if err != nil {
+		traceExitErr("mqSubscribe", 1, err)
+		return nil, err
+	}
+	traceExit("mqSubscribe", 0)
+	return &resourceSub{subObj: subObj, qObj: qObj}, nil
+}
+
+// inquireSubscriptionNames returns the SubName of every subscription that
+// matches the given (possibly wildcarded) pattern, using the
+// MQCMD_INQUIRE_SUBSCRIPTION PCF command.
+func inquireSubscriptionNames(qMgr *ibmmq.MQQueueManager, pattern string) ([]string, error) {
+	traceEntryF("inquireSubscriptionNames", "Pattern: %s", pattern)
+
+	names := make([]string, 0)
+	statusClearReplyQ()
+	putmqmd, pmo, cfh, buf := statusSetCommandHeaders()
+
+	cfh.Command = ibmmq.MQCMD_INQUIRE_SUBSCRIPTION
+
+	pcfparm := new(ibmmq.PCFParameter)
+	pcfparm.Type = ibmmq.MQCFT_STRING
+	pcfparm.Parameter = ibmmq.MQCACF_SUB_NAME
+	pcfparm.String = []string{pattern}
+	cfh.ParameterCount++
+	buf = append(buf, pcfparm.Bytes()...)
+
+	buf = append(cfh.Bytes(), buf...)
+
+	err := cmdQObj.Put(putmqmd, pmo, buf)
+	if err != nil {
+		traceExitErr("inquireSubscriptionNames", 1, err)
+		return names, err
+	}
+
+	for allReceived := false; !allReceived; {
+		cfh, buf, allReceived, err = statusGetReply()
+		if buf == nil {
+			continue
+		}
+		name := parseSubNameFromPCF(cfh, buf)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	traceExitErr("inquireSubscriptionNames", 0, err)
+	return names, err
+}
+
+// parseSubNameFromPCF extracts the MQCACF_SUB_NAME field from a single PCF
+// response message, returning "" if it is not present.
+func parseSubNameFromPCF(cfh *ibmmq.MQCFH, buf []byte) string {
+	var elem *ibmmq.PCFParameter
+	subName := ""
+
+	if cfh == nil || cfh.ParameterCount == 0 {
+		return ""
+	}
+
+	parmAvail := true
+	offset := 0
+	bytesRead := 0
+	datalen := len(buf)
+	for parmAvail && cfh.CompCode != ibmmq.MQCC_FAILED {
+		elem, bytesRead = ibmmq.ReadPCFParameter(buf[offset:])
+		offset += bytesRead
+		if offset >= datalen {
+			parmAvail = false
+		}
+		if elem.Parameter == ibmmq.MQCACF_SUB_NAME {
+			subName = strings.TrimSpace(elem.String[0])
+		}
+	}
+	return subName
+}
+
+// deleteSubscriptionByName removes a single durable subscription by name,
+// using the MQCMD_DELETE_SUBSCRIPTION PCF command. This is used by the standalone
+// cleanup mode where the subscription was not opened by this process, so
+// there is no local MQObject handle to close.
+func deleteSubscriptionByName(qMgr *ibmmq.MQQueueManager, subName string) error {
+	traceEntryF("deleteSubscriptionByName", "SubName: %s", subName)
+
+	statusClearReplyQ()
+	putmqmd, pmo, cfh, buf := statusSetCommandHeaders()
+
+	cfh.Command = ibmmq.MQCMD_DELETE_SUBSCRIPTION
+
+	pcfparm := new(ibmmq.PCFParameter)
+	pcfparm.Type = ibmmq.MQCFT_STRING
+	pcfparm.Parameter = ibmmq.MQCACF_SUB_NAME
+	pcfparm.String = []string{subName}
+	cfh.ParameterCount++
+	buf = append(buf, pcfparm.Bytes()...)
+
+	buf = append(cfh.Bytes(), buf...)
+
+	err := cmdQObj.Put(putmqmd, pmo, buf)
+	if err != nil {
+		traceExitErr("deleteSubscriptionByName", 1, err)
+		return err
+	}
+
+	for allReceived := false; !allReceived; {
+		cfh, buf, allReceived, err = statusGetReply()
+		_ = buf
+	}
+
+	traceExitErr("deleteSubscriptionByName", 0, err)
+	return err
+}
+
+// CleanupSubscriptionsByPrefix is intended for a standalone cleanup mode,
+// run independently of any live monitoring process, to remove durable
+// subscriptions left behind by a previous, possibly crashed, instance. It
+// inquires all subscriptions whose SubName starts with prefix + "/" and
+// deletes each one in turn, returning the names it removed.
+func CleanupSubscriptionsByPrefix(qMgr *ibmmq.MQQueueManager, prefix string) ([]string, error) {
+	traceEntryF("CleanupSubscriptionsByPrefix", "Prefix: %s", prefix)
+
+	removed := make([]string, 0)
+	if prefix == "" {
+		prefix = defaultDurableSubNamePrefix
+	}
+	wildcard := prefix + "/*"
+
+	names, err := inquireSubscriptionNames(qMgr, wildcard)
+	if err != nil {
+		traceExitErr("CleanupSubscriptionsByPrefix", 1, err)
+		return removed, err
+	}
+
+	for _, subName := range names {
+		if !strings.HasPrefix(subName, prefix+"/") {
+			continue
+		}
+		if err := deleteSubscriptionByName(qMgr, subName); err != nil {
+			traceExitErr("CleanupSubscriptionsByPrefix", 2, err)
+			return removed, err
+		}
+		removed = append(removed, subName)
+	}
+
+	traceExit("CleanupSubscriptionsByPrefix", 0)
+	return removed, nil
+}
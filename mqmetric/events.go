@@ -0,0 +1,375 @@
+package mqmetric
+
+/*
+  Copyright (c) IBM Corporation 2018,2020
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+   Contributors:
+     Mark Taylor - Initial Contribution
+*/
+
+/*
+CollectQueueStatus normally runs on a fixed scrape interval, which means
+time_since_put/time_since_get/oldest_message_age and the queue depth only
+get as fresh as the last poll, and a depth spike that comes and goes
+between polls is invisible. This file adds an opt-in, event-driven
+alternative: it reads the queue manager's own instrumentation events from
+SYSTEM.ADMIN.PERFM.EVENT and SYSTEM.ADMIN.QMGR.EVENT and updates
+QueueStatus in place as each event arrives, between polls. Each
+CollectQueueStatus poll still queries every selected queue and overwrites
+the polled values, including a depth set from an event; only the
+event-only counters carry over from one poll to the next.
+*/
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ibm-messaging/mq-golang/v5/ibmmq"
+)
+
+const (
+	// ATTR_Q_DEPTH_HIGH_EVENT_COUNT counts Queue Depth High and Queue Full
+	// events seen for a queue since the event stream started.
+	ATTR_Q_DEPTH_HIGH_EVENT_COUNT = "queue_depth_high_event_count"
+	// ATTR_Q_SVC_INTERVAL_BREACH counts Queue Service Interval High
+	// events, ie cases where a message sat on the queue longer than the
+	// configured service interval.
+	ATTR_Q_SVC_INTERVAL_BREACH = "queue_service_interval_breach"
+	// ATTR_Q_PUT_INHIBITED_EVENT_COUNT and ATTR_Q_GET_INHIBITED_EVENT_COUNT
+	// count Put Inhibited / Get Inhibited events seen for a queue since the
+	// event stream started.
+	ATTR_Q_PUT_INHIBITED_EVENT_COUNT = "queue_put_inhibited_event_count"
+	ATTR_Q_GET_INHIBITED_EVENT_COUNT = "queue_get_inhibited_event_count"
+
+	perfmEventQueue = "SYSTEM.ADMIN.PERFM.EVENT"
+	qmgrEventQueue  = "SYSTEM.ADMIN.QMGR.EVENT"
+)
+
+// EventStreamConfig configures StartQueueEventStream.
+type EventStreamConfig struct {
+	// AutoEnableEvents, when true, issues the equivalent of ALTER
+	// QLOCAL(name) QDPHIEV(ENABLED) QSVCIEV(HIGH) for each monitored queue,
+	// one command per queue, on startup, and the matching
+	// DISABLED/NONE on shutdown, so operators do not have to pre-configure
+	// every queue by hand.
+	AutoEnableEvents bool
+}
+
+// StartQueueEventStream opens the instrumentation event queues and
+// updates QueueStatus in place as events arrive, until ctx is cancelled.
+// It runs in its own goroutine and returns immediately; callers that want
+// to wait for it to finish should watch for ctx.Done() themselves.
+func StartQueueEventStream(ctx context.Context, cfg EventStreamConfig) error {
+	traceEntry("StartQueueEventStream")
+
+	QueueInitAttributes()
+	registerEventAttributes()
+
+	perfmObj, err := openEventQueue(perfmEventQueue)
+	if err != nil {
+		traceExitErr("StartQueueEventStream", 1, err)
+		return err
+	}
+	qmgrObj, err := openEventQueue(qmgrEventQueue)
+	if err != nil {
+		traceExitErr("StartQueueEventStream", 2, err)
+		return err
+	}
+
+	if cfg.AutoEnableEvents {
+		if err := setQueueEventAttributes(true); err != nil {
+			traceExitErr("StartQueueEventStream", 3, err)
+			return err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		if cfg.AutoEnableEvents {
+			_ = setQueueEventAttributes(false)
+		}
+		_ = perfmObj.Close(0)
+		_ = qmgrObj.Close(0)
+	}()
+
+	go eventReadLoop(ctx, perfmObj)
+	go eventReadLoop(ctx, qmgrObj)
+
+	traceExit("StartQueueEventStream", 0)
+	return nil
+}
+
+// registerEventAttributes adds the synthetic, event-only gauges to
+// QueueStatus if they are not already present. They have no underlying
+// PCF integer attribute (index -1) because they are derived purely from
+// counting events, not from a DISPLAY QSTATUS response.
+func registerEventAttributes() {
+	queueStatusMu.Lock()
+	defer queueStatusMu.Unlock()
+	if _, ok := QueueStatus.Attributes[ATTR_Q_DEPTH_HIGH_EVENT_COUNT]; !ok {
+		QueueStatus.Attributes[ATTR_Q_DEPTH_HIGH_EVENT_COUNT] = newStatusAttribute(ATTR_Q_DEPTH_HIGH_EVENT_COUNT, "Queue Depth High Event Count", -1)
+	}
+	if _, ok := QueueStatus.Attributes[ATTR_Q_SVC_INTERVAL_BREACH]; !ok {
+		QueueStatus.Attributes[ATTR_Q_SVC_INTERVAL_BREACH] = newStatusAttribute(ATTR_Q_SVC_INTERVAL_BREACH, "Queue Service Interval Breach Count", -1)
+	}
+	if _, ok := QueueStatus.Attributes[ATTR_Q_PUT_INHIBITED_EVENT_COUNT]; !ok {
+		QueueStatus.Attributes[ATTR_Q_PUT_INHIBITED_EVENT_COUNT] = newStatusAttribute(ATTR_Q_PUT_INHIBITED_EVENT_COUNT, "Queue Put Inhibited Event Count", -1)
+	}
+	if _, ok := QueueStatus.Attributes[ATTR_Q_GET_INHIBITED_EVENT_COUNT]; !ok {
+		QueueStatus.Attributes[ATTR_Q_GET_INHIBITED_EVENT_COUNT] = newStatusAttribute(ATTR_Q_GET_INHIBITED_EVENT_COUNT, "Queue Get Inhibited Event Count", -1)
+	}
+}
+
+// openEventQueue opens one of the SYSTEM.ADMIN.*.EVENT queues for
+// shared input, so other tools (eg a second monitor, or the queue
+// manager's own sample listener) can still read from it too.
+func openEventQueue(qName string) (ibmmq.MQObject, error) {
+	mqod := ibmmq.NewMQOD()
+	mqod.ObjectType = ibmmq.MQOT_Q
+	mqod.ObjectName = qName
+	openOptions := ibmmq.MQOO_INPUT_SHARED | ibmmq.MQOO_FAIL_IF_QUIESCING
+	return qMgr.Open(mqod, openOptions)
+}
+
+const (
+	// eventReadMaxBackoff caps how long eventReadLoop will wait between
+	// retries after a run of errors other than "no message available",
+	// eg 2035 not-authorized or the event queue having been deleted.
+	eventReadMaxBackoff = 30 * time.Second
+	// eventReadGiveUpAfter stops the loop entirely once this many
+	// consecutive errors have been seen, rather than retrying forever.
+	eventReadGiveUpAfter = 10
+)
+
+// eventReadLoop gets messages from an event queue in a loop until ctx is
+// cancelled, parsing and applying each one as it arrives. A run of errors
+// other than "no message available" backs off with growing delays instead
+// of spinning the goroutine at 100% CPU, and gives up after
+// eventReadGiveUpAfter consecutive failures.
+func eventReadLoop(ctx context.Context, obj ibmmq.MQObject) {
+	gmo := ibmmq.NewMQGMO()
+	gmo.Options = ibmmq.MQGMO_WAIT | ibmmq.MQGMO_NO_SYNCPOINT | ibmmq.MQGMO_CONVERT
+	gmo.WaitInterval = 2000 // poll the context every couple of seconds
+
+	buf := make([]byte, 32*1024)
+	consecutiveErrors := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		getmqmd := ibmmq.NewMQMD()
+		datalen, err := obj.Get(getmqmd, gmo, buf)
+		if err != nil {
+			if mqret, ok := err.(*ibmmq.MQReturn); ok && mqret.MQRC == ibmmq.MQRC_NO_MSG_AVAILABLE {
+				consecutiveErrors = 0
+				continue
+			}
+			consecutiveErrors++
+			if consecutiveErrors >= eventReadGiveUpAfter {
+				traceExitErr("eventReadLoop", 1, err)
+				return
+			}
+			backoff := time.Duration(consecutiveErrors) * time.Second
+			if backoff > eventReadMaxBackoff {
+				backoff = eventReadMaxBackoff
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		consecutiveErrors = 0
+		applyQueueEvent(buf[:datalen])
+	}
+}
+
+// applyQueueEvent parses a single PCF event message and, for the event
+// types we understand, updates QueueStatus.Attributes in place rather than
+// waiting for the next poll. No timestamp is stored with the values, so a
+// value set from an event cannot be told apart from a polled one.
+func applyQueueEvent(buf []byte) {
+	var elem *ibmmq.PCFParameter
+
+	cfh, bytesRead := ibmmq.ReadPCFHeader(buf)
+	offset := bytesRead
+	if cfh == nil || cfh.ParameterCount == 0 {
+		return
+	}
+
+	qName := ""
+	depth := int64(0)
+	haveDepth := false
+
+	parmAvail := true
+	datalen := len(buf)
+	for parmAvail {
+		elem, bytesRead = ibmmq.ReadPCFParameter(buf[offset:])
+		offset += bytesRead
+		if offset >= datalen {
+			parmAvail = false
+		}
+		switch elem.Parameter {
+		case ibmmq.MQCA_Q_NAME:
+			qName = strings.TrimSpace(elem.String[0])
+		case ibmmq.MQIA_CURRENT_Q_DEPTH:
+			depth = elem.Int64Value[0]
+			haveDepth = true
+		}
+	}
+	if qName == "" {
+		return
+	}
+
+	// Depth/Full/Low events carry the actual MQIA_CURRENT_Q_DEPTH that
+	// triggered them, so the gauge is only updated when that value was
+	// present in the event - never with a made-up placeholder.
+	switch cfh.Reason {
+	case ibmmq.MQRC_Q_DEPTH_HIGH:
+		bumpEventCounter(ATTR_Q_DEPTH_HIGH_EVENT_COUNT, qName)
+		if haveDepth {
+			setEventValue(ATTR_Q_DEPTH, qName, depth)
+		}
+	case ibmmq.MQRC_Q_DEPTH_LOW:
+		if haveDepth {
+			setEventValue(ATTR_Q_DEPTH, qName, depth)
+		}
+	case ibmmq.MQRC_Q_DEPTH_FULL:
+		bumpEventCounter(ATTR_Q_DEPTH_HIGH_EVENT_COUNT, qName)
+		if haveDepth {
+			setEventValue(ATTR_Q_DEPTH, qName, depth)
+		}
+	case ibmmq.MQRC_Q_SERVICE_INTERVAL_HIGH:
+		bumpEventCounter(ATTR_Q_SVC_INTERVAL_BREACH, qName)
+	case ibmmq.MQRC_PUT_INHIBITED:
+		bumpEventCounter(ATTR_Q_PUT_INHIBITED_EVENT_COUNT, qName)
+	case ibmmq.MQRC_GET_INHIBITED:
+		bumpEventCounter(ATTR_Q_GET_INHIBITED_EVENT_COUNT, qName)
+	}
+}
+
+// setEventValue records a fresh value for an existing attribute in place,
+// the same way a poll response would, so that a depth transition reported
+// by an event is visible immediately rather than waiting for the next
+// scrape.
+func setEventValue(attrName string, qName string, v int64) {
+	queueStatusMu.Lock()
+	defer queueStatusMu.Unlock()
+	attr, ok := QueueStatus.Attributes[attrName]
+	if !ok {
+		return
+	}
+	attr.Values[qName] = newStatusValueInt64(v)
+}
+
+// bumpEventCounter increments a synthetic, event-only counter for qName.
+func bumpEventCounter(attrName string, qName string) {
+	queueStatusMu.Lock()
+	defer queueStatusMu.Unlock()
+	attr, ok := QueueStatus.Attributes[attrName]
+	if !ok {
+		return
+	}
+	cur := int64(0)
+	if existing, ok := attr.Values[qName]; ok {
+		cur = existing.ValueInt64
+	}
+	attr.Values[qName] = newStatusValueInt64(cur + 1)
+}
+
+// setQueueEventAttributes enables or disables the QDPHIEV and QSVCIEV queue
+// attributes for every monitored queue, for
+// the AutoEnableEvents fallback. It walks qInfoMap rather than requiring
+// the caller to pass an explicit list, so it stays in step with whatever
+// discovery/filtering has already selected.
+func setQueueEventAttributes(enable bool) error {
+	traceEntryF("setQueueEventAttributes", "Enable: %v", enable)
+
+	depthSetting := ibmmq.MQEVR_DISABLED
+	svcSetting := ibmmq.MQQSIE_NONE
+	if enable {
+		depthSetting = ibmmq.MQEVR_ENABLED
+		svcSetting = ibmmq.MQQSIE_HIGH
+	}
+
+	var firstErr error
+	for qName, qi := range qInfoMap {
+		if len(qName) == 0 || !qi.exists {
+			continue
+		}
+		if err := alterQLocalEventAttrs(qName, depthSetting, svcSetting); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	traceExitErr("setQueueEventAttributes", 0, firstErr)
+	return firstErr
+}
+
+// alterQLocalEventAttrs issues MQCMD_CHANGE_Q to set QDPHIEV and QSVCIEV on
+// a single local queue. Both are integer-valued attributes - QDPHIEV takes
+// an MQEVR_* enabled/disabled value and QSVCIEV takes an MQQSIE_* severity
+// value - not strings.
+func alterQLocalEventAttrs(qName string, depthSetting int32, svcSetting int32) error {
+	statusClearReplyQ()
+	putmqmd, pmo, cfh, buf := statusSetCommandHeaders()
+
+	cfh.Command = ibmmq.MQCMD_CHANGE_Q
+
+	pcfparm := new(ibmmq.PCFParameter)
+	pcfparm.Type = ibmmq.MQCFT_STRING
+	pcfparm.Parameter = ibmmq.MQCA_Q_NAME
+	pcfparm.String = []string{qName}
+	cfh.ParameterCount++
+	buf = append(buf, pcfparm.Bytes()...)
+
+	pcfparm = new(ibmmq.PCFParameter)
+	pcfparm.Type = ibmmq.MQCFT_INTEGER
+	pcfparm.Parameter = ibmmq.MQIA_Q_TYPE
+	pcfparm.Int64Value = []int64{int64(ibmmq.MQQT_LOCAL)}
+	cfh.ParameterCount++
+	buf = append(buf, pcfparm.Bytes()...)
+
+	pcfparm = new(ibmmq.PCFParameter)
+	pcfparm.Type = ibmmq.MQCFT_INTEGER
+	pcfparm.Parameter = ibmmq.MQIA_Q_DEPTH_HIGH_EVENT
+	pcfparm.Int64Value = []int64{int64(depthSetting)}
+	cfh.ParameterCount++
+	buf = append(buf, pcfparm.Bytes()...)
+
+	pcfparm = new(ibmmq.PCFParameter)
+	pcfparm.Type = ibmmq.MQCFT_INTEGER
+	pcfparm.Parameter = ibmmq.MQIA_Q_SERVICE_INTERVAL_EVENT
+	pcfparm.Int64Value = []int64{int64(svcSetting)}
+	cfh.ParameterCount++
+	buf = append(buf, pcfparm.Bytes()...)
+
+	buf = append(cfh.Bytes(), buf...)
+
+	err := cmdQObj.Put(putmqmd, pmo, buf)
+	if err != nil {
+		return err
+	}
+
+	for allReceived := false; !allReceived; {
+		_, _, allReceived, err = statusGetReply()
+	}
+	return err
+}
@@ -0,0 +1,197 @@
+/*
+Package kafka publishes StatusSet snapshots collected by mqmetric - queue
+status, and in future channel/subscription status - to a Kafka topic, as
+either JSON or OpenMetrics line records. It is modeled on the pull-based
+scraping pattern used by log shippers that tail a Kafka topic for
+Prometheus-compatible payloads: this package is the producer side of that
+pipeline, writing one record per queue per collection interval rather than exposing
+an HTTP endpoint for a scraper to pull from.
+*/
+package kafka
+
+/*
+  Copyright (c) IBM Corporation 2018,2020
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+   Contributors:
+     Mark Taylor - Initial Contribution
+*/
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/rjseibert/mq-golang/mqmetric"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// Format selects how a StatusSnapshot is serialized onto the wire.
+type Format int
+
+const (
+	// FormatJSON writes each queue's points as a JSON array of
+	// AttributeSnapshot objects.
+	FormatJSON Format = iota
+	// FormatOpenMetrics writes one OpenMetrics text-format line per point.
+	FormatOpenMetrics
+)
+
+// SASLConfig carries SASL/PLAIN credentials for brokers that require
+// authentication. It is left empty/unused for unauthenticated clusters.
+type SASLConfig struct {
+	Username string
+	Password string
+}
+
+// Config describes a Kafka publishing destination.
+type Config struct {
+	Brokers    []string
+	Topic      string
+	ClientID   string
+	SASL       *SASLConfig
+	TLS        *tls.Config
+	BatchBytes int64 // 0 selects the kafka-go default
+	LingerMs   int   // 0 selects the kafka-go default
+	Format     Format
+}
+
+// Publisher writes StatusSnapshots to a single Kafka topic. A schema
+// header, describing each attribute once, is sent on the first Publish
+// call after connecting and omitted afterwards to keep later payloads
+// small - downstream consumers are expected to cache it for the lifetime
+// of the connection.
+type Publisher struct {
+	cfg        Config
+	writer     *kafkago.Writer
+	schemaSent bool
+}
+
+// New creates a Publisher for the given configuration. It does not dial
+// the brokers itself; kafka-go's writer connects lazily on the first
+// Publish call.
+func New(cfg Config) (*Publisher, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka: at least one broker is required")
+	}
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("kafka: topic is required")
+	}
+
+	transport := &kafkago.Transport{
+		TLS: cfg.TLS,
+	}
+	if cfg.SASL != nil {
+		transport.SASL = plain.Mechanism{
+			Username: cfg.SASL.Username,
+			Password: cfg.SASL.Password,
+		}
+	}
+
+	writer := &kafkago.Writer{
+		Addr:         kafkago.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafkago.Hash{},
+		BatchBytes:   cfg.BatchBytes,
+		BatchTimeout: time.Duration(cfg.LingerMs) * time.Millisecond,
+		Transport:    transport,
+		RequiredAcks: kafkago.RequireOne,
+	}
+
+	return &Publisher{cfg: cfg, writer: writer}, nil
+}
+
+// Publish serializes a snapshot according to cfg.Format and writes it to
+// the topic, one Kafka message per queue so that the partition-key
+// selection below can shard consistently by queue name. snapshot.Descriptions,
+// if present, is sent as a "mqmetric-schema" header on the first message of the
+// connection only; subsequent calls should pass a snapshot with
+// Descriptions left nil.
+func (p *Publisher) Publish(ctx context.Context, snapshot mqmetric.StatusSnapshot) error {
+	byQueue := make(map[string][]mqmetric.AttributeSnapshot)
+	for _, pt := range snapshot.Points {
+		byQueue[pt.QueueName] = append(byQueue[pt.QueueName], pt)
+	}
+
+	var schemaHeaders []kafkago.Header
+	if !p.schemaSent && len(snapshot.Descriptions) > 0 {
+		schemaJSON, err := json.Marshal(snapshot.Descriptions)
+		if err != nil {
+			return fmt.Errorf("kafka: marshal schema header: %w", err)
+		}
+		schemaHeaders = []kafkago.Header{{Key: "mqmetric-schema", Value: schemaJSON}}
+	}
+
+	messages := make([]kafkago.Message, 0, len(byQueue))
+	for qName, points := range byQueue {
+		value, err := p.encode(points)
+		if err != nil {
+			return fmt.Errorf("kafka: encode %s: %w", qName, err)
+		}
+		messages = append(messages, kafkago.Message{
+			Key:     partitionKey(qName),
+			Value:   value,
+			Headers: schemaHeaders,
+		})
+		schemaHeaders = nil // only attach to the first message of the batch
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	if err := p.writer.WriteMessages(ctx, messages...); err != nil {
+		return fmt.Errorf("kafka: write messages: %w", err)
+	}
+	p.schemaSent = true
+	return nil
+}
+
+// Close flushes any buffered messages and closes the underlying Kafka
+// writer. It should be called once during an orderly shutdown.
+func (p *Publisher) Close() error {
+	return p.writer.Close()
+}
+
+func (p *Publisher) encode(points []mqmetric.AttributeSnapshot) ([]byte, error) {
+	switch p.cfg.Format {
+	case FormatOpenMetrics:
+		return encodeOpenMetrics(points), nil
+	default:
+		return json.Marshal(points)
+	}
+}
+
+func encodeOpenMetrics(points []mqmetric.AttributeSnapshot) []byte {
+	var buf []byte
+	for _, pt := range points {
+		line := fmt.Sprintf("%s{queue=%q,qmgr=%q,platform=%q} %v %d\n",
+			pt.Attribute, pt.QueueName, pt.QMgrName, pt.Platform, pt.Value, pt.Timestamp)
+		buf = append(buf, []byte(line)...)
+	}
+	return buf
+}
+
+// partitionKey hashes a queue name to a stable byte key so that all
+// records for the same queue land on the same partition, letting
+// downstream consumers shard by queue without coordinating separately.
+func partitionKey(qName string) []byte {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(qName))
+	return []byte(fmt.Sprintf("%08x", h.Sum32()))
+}
@@ -33,6 +33,7 @@ import (
 	//	"fmt"
 	"github.com/ibm-messaging/mq-golang/v5/ibmmq"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -66,6 +67,14 @@ const (
 var QueueStatus StatusSet
 var qAttrsInit = false
 
+// queueStatusMu guards all reads and writes of QueueStatus and its
+// Attributes[*].Values maps. A scrape-driven CollectQueueStatus call runs
+// concurrently with the event-stream goroutines in events.go, and both
+// sides mutate the same maps - including CollectQueueStatus replacing them
+// outright at the start of every poll - so every access needs to go through
+// this lock to avoid a concurrent map write.
+var queueStatusMu sync.Mutex
+
 /*
 Unlike the statistics produced via a topic, there is no discovery
 of the attributes available in object STATUS queries. There is also
@@ -112,7 +121,7 @@ func QueueInitAttributes() {
 		QueueStatus.Attributes[attr] = newStatusAttribute(attr, "Queue Depth", ibmmq.MQIA_CURRENT_Q_DEPTH)
 	}
 
-	if platform == ibmmq.MQPL_ZOS && useResetQStats {
+	if resetQStatsIntervalAttrsAllowed() {
 		attr = ATTR_Q_INTERVAL_PUT
 		QueueStatus.Attributes[attr] = newStatusAttribute(attr, "Put/Put1 Count", ibmmq.MQIA_MSG_ENQ_COUNT)
 		attr = ATTR_Q_INTERVAL_GET
@@ -163,52 +172,58 @@ func CollectQueueStatus(patterns string) error {
 	QueueInitAttributes()
 
 	// Empty any collected values
+	queueStatusMu.Lock()
 	for k := range QueueStatus.Attributes {
+		// The event-only counters from events.go accumulate across polls
+		switch k {
+		case ATTR_Q_DEPTH_HIGH_EVENT_COUNT, ATTR_Q_SVC_INTERVAL_BREACH,
+			ATTR_Q_PUT_INHIBITED_EVENT_COUNT, ATTR_Q_GET_INHIBITED_EVENT_COUNT:
+			continue
+		}
 		QueueStatus.Attributes[k].Values = make(map[string]*StatusValue)
 	}
+	queueStatusMu.Unlock()
+
+	qf, err := ParseQueueFilter(patterns)
+	if err != nil {
+		traceExitErr("CollectQueueStatus", 2, err)
+		return err
+	}
 
-	queuePatterns := strings.Split(patterns, ",")
-	if len(queuePatterns) == 0 {
+	// A blank spec collects nothing, matching the historical behaviour of
+	// an empty comma-separated pattern list.
+	if qf.IsEmpty() {
 		traceExit("CollectQueueStatus", 1)
 		return nil
 	}
 
-	// If there was a negative pattern, then we have to look through the
-	// list of queues and query status individually. Otherwise we can
-	// use regular MQ patterns to query queues in a batch.
-	if strings.Contains(patterns, "!") {
-		for qName, qi := range qInfoMap {
-			if len(qName) == 0 || !qi.exists {
-				continue
-			}
-			err = collectQueueStatus(qName, ibmmq.MQOT_Q)
-			if err == nil && useResetQStats {
-				err = collectResetQStats(qName)
-			}
-		}
-	} else {
-		for _, pattern := range queuePatterns {
-			pattern = strings.TrimSpace(pattern)
-			if len(pattern) == 0 {
-				continue
-			}
-
-			err = collectQueueStatus(pattern, ibmmq.MQOT_Q)
-			if err == nil && useResetQStats {
-				err = collectResetQStats(pattern)
-			}
+	// Every include pattern - or "*" when there are none, or when a regex is
+	// present - is queried as a single wildcarded batch request. Any exclude/regex/type restriction is then
+	// applied to the names each batch query returns, so a restriction never
+	// falls back to querying every queue in qInfoMap individually.
+	for _, pattern := range qf.BatchPatterns() {
+		err = collectQueueStatus(pattern, ibmmq.MQOT_Q, qf)
+		if err == nil && resetQStatsAllowed() {
+			err = collectResetQStats(pattern, qf)
 		}
 	}
 	traceExitErr("CollectQueueStatus", 0, err)
 	return err
 }
 
-// Issue the INQUIRE_QUEUE_STATUS command for a queue or wildcarded queue name
-// Collect the responses and build up the statistics
-func collectQueueStatus(pattern string, instanceType int32) error {
+// Issue the INQUIRE_QUEUE_STATUS command for a queue or wildcarded queue
+// name, collect the responses and build up the statistics. qf, if non-nil,
+// is applied to each returned queue name so that excludes/regexes/type
+// restrictions can filter a wildcarded batch response rather than requiring
+// a separate query per queue.
+func collectQueueStatus(pattern string, instanceType int32, qf *QueueFilter) error {
 	var err error
 	traceEntryF("collectQueueStatus", "Pattern: %s", pattern)
 
+	// The PCF command reply queue is unrelated to resource-topic
+	// subscriptions, so it is always drained before each request - a
+	// previous, failed collectQueueStatus could otherwise leave stale
+	// replies behind that get misparsed as current data.
 	statusClearReplyQ()
 
 	putmqmd, pmo, cfh, buf := statusSetCommandHeaders()
@@ -247,7 +262,7 @@ func collectQueueStatus(pattern string, instanceType int32) error {
 	for allReceived := false; !allReceived; {
 		cfh, buf, allReceived, err = statusGetReply()
 		if buf != nil {
-			parseQData(instanceType, cfh, buf)
+			parseQData(instanceType, cfh, buf, qf)
 		}
 	}
 
@@ -255,10 +270,27 @@ func collectQueueStatus(pattern string, instanceType int32) error {
 	return err
 }
 
-func collectResetQStats(pattern string) error {
+func collectResetQStats(pattern string, qf *QueueFilter) error {
 	var err error
 
 	traceEntry("collectResetQStats")
+
+	if resetQStatsMode == ResetQStatsSharedCoordinated {
+		granted, lockErr := acquireResetQStatsLock()
+		if lockErr != nil {
+			traceExitErr("collectResetQStats", 2, lockErr)
+			return lockErr
+		}
+		if !granted {
+			// Another reader currently holds the lock. Back off for this
+			// interval rather than risk double-counting; ResetQStatsLockWarnings
+			// has already been incremented so callers can alert on it.
+			traceExit("collectResetQStats", 3)
+			return nil
+		}
+		defer releaseResetQStatsLock()
+	}
+
 	statusClearReplyQ()
 	putmqmd, pmo, cfh, buf := statusSetCommandHeaders()
 
@@ -287,7 +319,7 @@ func collectResetQStats(pattern string) error {
 	for allReceived := false; !allReceived; {
 		cfh, buf, allReceived, err = statusGetReply()
 		if buf != nil {
-			parseResetQStatsData(cfh, buf)
+			parseResetQStatsData(cfh, buf, qf)
 		}
 	}
 	traceExitErr("collectResetQueueStats", 0, err)
@@ -359,8 +391,11 @@ func inquireQueueAttributes(objectPatternsList string) error {
 	return nil
 }
 
-// Given a PCF response message, parse it to extract the desired statistics
-func parseQData(instanceType int32, cfh *ibmmq.MQCFH, buf []byte) string {
+// Given a PCF response message, parse it to extract the desired statistics.
+// qf, if non-nil, is checked against the queue name before anything is
+// stored, so that a wildcarded batch query can still honour excludes,
+// regexes and a type restriction.
+func parseQData(instanceType int32, cfh *ibmmq.MQCFH, buf []byte, qf *QueueFilter) string {
 	var elem *ibmmq.PCFParameter
 
 	traceEntry("parseQData")
@@ -397,8 +432,15 @@ func parseQData(instanceType int32, cfh *ibmmq.MQCFH, buf []byte) string {
 		}
 	}
 
+	if qf != nil && (!qf.Matches(qName) || !qf.matchesType(qName)) {
+		traceExitF("parseQData", 2, "Key: %s excluded", qName)
+		return ""
+	}
+
 	// Create a unique key for this instance
 	key = qName
+	queueStatusMu.Lock()
+	defer queueStatusMu.Unlock()
 	QueueStatus.Attributes[ATTR_Q_NAME].Values[key] = newStatusValueString(qName)
 
 	// And then re-parse the message so we can store the metrics now knowing the map key
@@ -439,8 +481,9 @@ func parseQData(instanceType int32, cfh *ibmmq.MQCFH, buf []byte) string {
 	return key
 }
 
-// Given a PCF response message, parse it to extract the desired statistics
-func parseResetQStatsData(cfh *ibmmq.MQCFH, buf []byte) string {
+// Given a PCF response message, parse it to extract the desired statistics.
+// qf, if non-nil, is applied the same way as in parseQData.
+func parseResetQStatsData(cfh *ibmmq.MQCFH, buf []byte, qf *QueueFilter) string {
 	var elem *ibmmq.PCFParameter
 
 	traceEntry("parseResetQStatsData")
@@ -472,9 +515,16 @@ func parseResetQStatsData(cfh *ibmmq.MQCFH, buf []byte) string {
 		}
 	}
 
+	if qf != nil && (!qf.Matches(qName) || !qf.matchesType(qName)) {
+		traceExitF("parseResetQStatsData", 2, "Key: %s excluded", qName)
+		return ""
+	}
+
 	// Create a unique key for this instance
 	key = qName
 
+	queueStatusMu.Lock()
+	defer queueStatusMu.Unlock()
 	QueueStatus.Attributes[ATTR_Q_NAME].Values[key] = newStatusValueString(qName)
 
 	// And then re-parse the message so we can store the metrics now knowing the map key
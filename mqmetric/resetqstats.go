@@ -0,0 +1,252 @@
+package mqmetric
+
+/*
+  Copyright (c) IBM Corporation 2018,2020
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+   Contributors:
+     Mark Taylor - Initial Contribution
+*/
+
+/*
+This file controls when the destructive MQCMD_RESET_Q_STATS command is
+used to obtain the interval put/get/high-depth counters. On z/OS, resetting
+is the only way to get these values and every queue manager-aware reader
+is expected to tolerate it. On Distributed platforms the same command
+works but resets state for every other consumer of it too, so it must
+only be issued when this is the one and only reader, or when readers
+coordinate with each other via a shared lock queue.
+*/
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ibm-messaging/mq-golang/v5/ibmmq"
+)
+
+// ResetQStatsMode controls when CollectQueueStatus is allowed to issue the
+// destructive MQCMD_RESET_Q_STATS command.
+type ResetQStatsMode int
+
+const (
+	// ResetQStatsOff never issues RESET_Q_STATS; ATTR_Q_INTERVAL_* values
+	// are not populated.
+	ResetQStatsOff ResetQStatsMode = iota
+	// ResetQStatsZOSOnly issues RESET_Q_STATS only on z/OS, which is the
+	// platform's normal way of obtaining these counters. This is the
+	// historical behaviour of useResetQStats.
+	ResetQStatsZOSOnly
+	// ResetQStatsAlways issues RESET_Q_STATS on any platform, on the
+	// assumption that this process is the only reader of the interval
+	// counters and resetting them is therefore safe.
+	ResetQStatsAlways
+	// ResetQStatsSharedCoordinated issues RESET_Q_STATS on any platform,
+	// but first takes out a lock against resetQStatsLockQName so that
+	// other coordinating readers do not double-count or silently lose
+	// counts to each other.
+	ResetQStatsSharedCoordinated
+)
+
+const (
+	// resetQStatsLockTimeout bounds how long collectResetQStats will wait
+	// to acquire the coordination lock before giving up for this interval.
+	resetQStatsLockTimeout = 5 * time.Second
+)
+
+var (
+	// resetQStatsMode defaults to Off, matching the historical behaviour
+	// of useResetQStats defaulting to false: callers had to opt in before
+	// RESET_Q_STATS was ever issued, even on z/OS. Call
+	// SetResetQStatsMode(ResetQStatsZOSOnly, "") to restore the previous
+	// "on for z/OS" behaviour.
+	resetQStatsMode      = ResetQStatsOff
+	resetQStatsLockQName = ""
+
+	// ResetQStatsLockWarnings counts the number of intervals in which
+	// SharedCoordinated mode failed to acquire the coordination lock in
+	// time and had to skip the reset for that interval, rather than risk
+	// double-counting. Exporters can surface this as a free-standing
+	// warning gauge.
+	ResetQStatsLockWarnings int64
+)
+
+// SetResetQStatsMode configures when RESET_Q_STATS is used to collect the
+// interval put/get/high-depth counters. lockQueueName is only consulted
+// when mode is ResetQStatsSharedCoordinated; it names the queue used to
+// serialize access with other readers via a PCF lock message.
+func SetResetQStatsMode(mode ResetQStatsMode, lockQueueName string) {
+	traceEntry("SetResetQStatsMode")
+	resetQStatsMode = mode
+	resetQStatsLockQName = lockQueueName
+	traceExit("SetResetQStatsMode", 0)
+}
+
+// resetQStatsAllowed reports whether the configured mode permits issuing
+// RESET_Q_STATS on the current platform.
+func resetQStatsAllowed() bool {
+	switch resetQStatsMode {
+	case ResetQStatsOff:
+		return false
+	case ResetQStatsZOSOnly:
+		return platform == ibmmq.MQPL_ZOS
+	case ResetQStatsAlways, ResetQStatsSharedCoordinated:
+		return true
+	}
+	return false
+}
+
+// resetQStatsIntervalAttrsAllowed reports whether QueueInitAttributes
+// should register the interval attributes (ATTR_Q_INTERVAL_PUT etc) for
+// the current platform and mode.
+func resetQStatsIntervalAttrsAllowed() bool {
+	if platform == ibmmq.MQPL_ZOS {
+		return resetQStatsMode != ResetQStatsOff
+	}
+	return resetQStatsMode == ResetQStatsAlways || resetQStatsMode == ResetQStatsSharedCoordinated
+}
+
+// acquireResetQStatsLock takes out mutual exclusion against
+// resetQStatsLockQName, bounded by resetQStatsLockTimeout, and returns
+// true if the lock was obtained. It is only meaningful in
+// ResetQStatsSharedCoordinated mode.
+//
+// The coordination queue is expected to be provisioned, once, with a
+// single small "token" message (eg via an amqsput of any short payload).
+// Acquiring the lock is an MQGET of that token under syncpoint: the token
+// becomes invisible to every other reader for as long as this unit of
+// work is open, which is exactly the mutual exclusion we need, and a
+// reader that times out waiting for it knows the lock is currently held
+// elsewhere. Releasing the lock puts the token back, still under the same
+// syncpoint, and then commits - so the put and the original get become
+// visible atomically and no window exists where the token is missing or
+// duplicated.
+func acquireResetQStatsLock() (bool, error) {
+	traceEntry("acquireResetQStatsLock")
+
+	if resetQStatsLockQName == "" {
+		traceExitErr("acquireResetQStatsLock", 1, fmt.Errorf("no coordination queue configured"))
+		return false, fmt.Errorf("mqmetric: SharedCoordinated reset mode requires a lock queue name")
+	}
+
+	lq, err := openLockQueue(resetQStatsLockQName)
+	if err != nil {
+		traceExitErr("acquireResetQStatsLock", 2, err)
+		return false, err
+	}
+
+	granted, err := lq.acquire(resetQStatsLockTimeout)
+	if err != nil {
+		traceExitErr("acquireResetQStatsLock", 3, err)
+		return false, err
+	}
+	if !granted {
+		ResetQStatsLockWarnings++
+	}
+
+	traceExit("acquireResetQStatsLock", 0)
+	return granted, nil
+}
+
+// releaseResetQStatsLock hands the lock back by restoring the
+// coordination token and committing the unit of work opened by
+// acquireResetQStatsLock. It is a no-op if the lock is not currently held,
+// so callers can defer it unconditionally after a successful acquire.
+func releaseResetQStatsLock() error {
+	traceEntry("releaseResetQStatsLock")
+	lq, ok := openLockQueues[resetQStatsLockQName]
+	if !ok {
+		traceExit("releaseResetQStatsLock", 1)
+		return nil
+	}
+	err := lq.release()
+	traceExitErr("releaseResetQStatsLock", 0, err)
+	return err
+}
+
+// lockQueue is a thin wrapper round an open handle to the coordination
+// queue, reused across intervals rather than being reopened on every
+// collection.
+type lockQueue struct {
+	obj  ibmmq.MQObject
+	held bool
+}
+
+var openLockQueues = make(map[string]*lockQueue)
+
+// openLockQueue opens (or returns the already-open handle for) the named
+// coordination queue.
+func openLockQueue(lockQName string) (*lockQueue, error) {
+	if lq, ok := openLockQueues[lockQName]; ok {
+		return lq, nil
+	}
+
+	mqod := ibmmq.NewMQOD()
+	mqod.ObjectType = ibmmq.MQOT_Q
+	mqod.ObjectName = lockQName
+	openOptions := ibmmq.MQOO_INPUT_SHARED | ibmmq.MQOO_OUTPUT | ibmmq.MQOO_FAIL_IF_QUIESCING
+
+	obj, err := qMgr.Open(mqod, openOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	lq := &lockQueue{obj: obj}
+	openLockQueues[lockQName] = lq
+	return lq, nil
+}
+
+// acquire takes the coordination token off the queue under syncpoint. A
+// timeout waiting for the token means some other reader currently holds
+// it; that is reported as granted == false rather than an error.
+func (lq *lockQueue) acquire(timeout time.Duration) (bool, error) {
+	gmo := ibmmq.NewMQGMO()
+	gmo.Options = ibmmq.MQGMO_WAIT | ibmmq.MQGMO_SYNCPOINT | ibmmq.MQGMO_CONVERT
+	gmo.WaitInterval = int32(timeout / time.Millisecond)
+
+	getmqmd := ibmmq.NewMQMD()
+	buf := make([]byte, 256)
+	_, err := lq.obj.Get(getmqmd, gmo, buf)
+	if err != nil {
+		if mqret, ok := err.(*ibmmq.MQReturn); ok && mqret.MQRC == ibmmq.MQRC_NO_MSG_AVAILABLE {
+			return false, nil
+		}
+		return false, err
+	}
+
+	lq.held = true
+	return true, nil
+}
+
+// release puts the coordination token back, under the same syncpoint as
+// the acquiring get, and commits - which is what actually lets the token
+// be seen by the next reader. If the put fails, the unit of work is
+// backed out instead of committed so the original get is undone and the
+// token is not lost.
+func (lq *lockQueue) release() error {
+	if !lq.held {
+		return nil
+	}
+	lq.held = false
+
+	putmqmd := ibmmq.NewMQMD()
+	pmo := ibmmq.NewMQPMO()
+	pmo.Options = ibmmq.MQPMO_SYNCPOINT
+
+	if err := lq.obj.Put(putmqmd, pmo, []byte("LOCK_TOKEN")); err != nil {
+		_ = qMgr.Back()
+		return err
+	}
+	return qMgr.Cmit()
+}
@@ -0,0 +1,100 @@
+package mqmetric
+
+/*
+  Copyright (c) IBM Corporation 2018,2020
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+   Contributors:
+     Mark Taylor - Initial Contribution
+*/
+
+/*
+This file builds a stable, serializable snapshot of a StatusSet such as
+QueueStatus. Prometheus and InfluxDB exporters read StatusAttribute.Values
+directly because they run in-process, but an out-of-process publisher -
+for example the kafka package alongside this one - needs a plain data
+structure it can marshal, so it is not coupled to the internal map shapes
+used for metric lookups.
+*/
+
+// AttributeSnapshot is one (object, attribute) data point taken from a
+// StatusSet at a point in time.
+type AttributeSnapshot struct {
+	QueueName string  `json:"queueName"`
+	Attribute string  `json:"attribute"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"` // Unix epoch seconds, caller-supplied
+	QMgrName  string  `json:"qmgrName"`
+	Platform  string  `json:"platform"`
+}
+
+// StatusSnapshot is a flat list of data points taken from a StatusSet, in
+// no defined order, plus the attribute descriptions needed to interpret them.
+// Callers that send a snapshot repeatedly - eg once per publish connect -
+// can omit Descriptions on subsequent calls to avoid resending the same
+// metadata on every message.
+type StatusSnapshot struct {
+	Points       []AttributeSnapshot `json:"points"`
+	Descriptions map[string]string   `json:"descriptions,omitempty"`
+}
+
+// SnapshotQueueStatus copies the current contents of QueueStatus into a
+// StatusSnapshot. Every point's Timestamp is set to the caller-supplied
+// timestamp; this function does not read the clock itself.
+func SnapshotQueueStatus(qMgrName string, platformName string, timestamp int64, includeDescriptions bool) StatusSnapshot {
+	traceEntry("SnapshotQueueStatus")
+
+	queueStatusMu.Lock()
+	defer queueStatusMu.Unlock()
+
+	snap := StatusSnapshot{
+		Points: make([]AttributeSnapshot, 0),
+	}
+
+	nameAttr, hasNames := QueueStatus.Attributes[ATTR_Q_NAME]
+	if !hasNames {
+		traceExit("SnapshotQueueStatus", 1)
+		return snap
+	}
+
+	if includeDescriptions {
+		snap.Descriptions = make(map[string]string)
+		for attrName, attr := range QueueStatus.Attributes {
+			snap.Descriptions[attrName] = attr.Description
+		}
+	}
+
+	for key := range nameAttr.Values {
+		for attrName, attr := range QueueStatus.Attributes {
+			if attrName == ATTR_Q_NAME {
+				continue
+			}
+			v, ok := attr.Values[key]
+			if !ok {
+				continue
+			}
+			snap.Points = append(snap.Points, AttributeSnapshot{
+				QueueName: key,
+				Attribute: attrName,
+				Value:     QueueNormalise(attr, v.ValueInt64),
+				Timestamp: timestamp,
+				QMgrName:  qMgrName,
+				Platform:  platformName,
+			})
+		}
+	}
+
+	traceExit("SnapshotQueueStatus", 0)
+	return snap
+}